@@ -0,0 +1,178 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// gcraCheckScript implements the Generic Cell Rate Algorithm for all three
+// dimensions (requests/minute, tokens/minute, requests/day) in one atomic
+// script, storing each dimension's theoretical arrival time (tat) as a
+// single string under its own key instead of a calendar-window counter.
+//
+// KEYS: [1] request tat key, [2] token tat key, [3] day-request tat key
+// ARGV: [1] requests-per-minute limit, [2] tokens-per-minute limit,
+//
+//	[3] requests-per-day limit, [4] token cost, [5] now (unix-millis),
+//	[6] minute period (millis), [7] day period (millis)
+//
+// now/periods are millisecond-resolution, not nanosecond: Lua numbers are
+// float64, whose 53-bit mantissa can't represent a current unix-nanosecond
+// timestamp exactly, and the rounding error compounds every time a tat is
+// read back and rewritten. Millisecond resolution keeps every value this
+// script handles well within the 2^53 exactly-representable range.
+//
+// Returns {allowed (0/1), reqUsed, tokensUsed, dayUsed, rejectionCode,
+// retryAfterMillis}, where reqUsed/tokensUsed/dayUsed approximate the
+// number of currently consumed slots in each window (derived from the
+// tat) and rejectionCode is 0 when allowed, else 1 (requests per minute),
+// 2 (tokens per minute) or 3 (requests per day).
+const gcraCheckScript = `
+local function gcra_check(key, limit, cost, period, now)
+	if limit <= 0 then
+		-- Matches the windows engine's fail-closed default: an unset/zero
+		-- legacy limit field blocks every request in that dimension rather
+		-- than leaving it unenforced.
+		return now, now, now + period, 0
+	end
+	local tat = tonumber(redis.call('GET', key))
+	if not tat or tat < now then
+		tat = now
+	end
+	local emission = period / limit
+	local new_tat = tat + cost * emission
+	local allow_at = new_tat - period
+	return tat, new_tat, allow_at, emission
+end
+
+local function gcra_used(tat, now, period, emission, limit)
+	if limit <= 0 then
+		return 0
+	end
+	local u = math.ceil((tat - now) / emission)
+	if u < 0 then u = 0 end
+	if u > limit then u = limit end
+	return u
+end
+
+local reqLimit = tonumber(ARGV[1])
+local tokenLimit = tonumber(ARGV[2])
+local dayLimit = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+local minutePeriod = tonumber(ARGV[6])
+local dayPeriod = tonumber(ARGV[7])
+local minutePeriodMs = ARGV[6]
+local dayPeriodMs = ARGV[7]
+
+local reqTat, reqNewTat, reqAllowAt, reqEmission = gcra_check(KEYS[1], reqLimit, 1, minutePeriod, now)
+local tokTat, tokNewTat, tokAllowAt, tokEmission = gcra_check(KEYS[2], tokenLimit, cost, minutePeriod, now)
+local dayTat, dayNewTat, dayAllowAt, dayEmission = gcra_check(KEYS[3], dayLimit, 1, dayPeriod, now)
+
+local reqUsed = gcra_used(reqTat, now, minutePeriod, reqEmission, reqLimit)
+local tokUsed = gcra_used(tokTat, now, minutePeriod, tokEmission, tokenLimit)
+local dayUsed = gcra_used(dayTat, now, dayPeriod, dayEmission, dayLimit)
+
+if now < reqAllowAt then
+	return {0, reqUsed, tokUsed, dayUsed, 1, reqAllowAt - now}
+end
+if now < tokAllowAt then
+	return {0, reqUsed, tokUsed, dayUsed, 2, tokAllowAt - now}
+end
+if now < dayAllowAt then
+	return {0, reqUsed, tokUsed, dayUsed, 3, dayAllowAt - now}
+end
+
+redis.call('SET', KEYS[1], reqNewTat, 'PX', minutePeriodMs)
+redis.call('SET', KEYS[2], tokNewTat, 'PX', minutePeriodMs)
+redis.call('SET', KEYS[3], dayNewTat, 'PX', dayPeriodMs)
+
+return {
+	1,
+	gcra_used(reqNewTat, now, minutePeriod, reqEmission, reqLimit),
+	gcra_used(tokNewTat, now, minutePeriod, tokEmission, tokenLimit),
+	gcra_used(dayNewTat, now, dayPeriod, dayEmission, dayLimit),
+	0,
+	0,
+}
+`
+
+// gcraKeysFor returns the non-rotating tat keys used by the GCRA algorithm.
+// Unlike windowKeysFor, these never change with the clock: the GCRA state
+// is a running arrival time, not a value that resets at a window boundary.
+func (rl *RateLimiter) gcraKeysFor(identity string) (reqKey, tokenKey, dayKey string) {
+	prefix := rl.keyPrefixFor(identity)
+
+	reqKey = fmt.Sprintf("%s:gcra:req", prefix)
+	tokenKey = fmt.Sprintf("%s:gcra:tokens", prefix)
+	dayKey = fmt.Sprintf("%s:gcra:day", prefix)
+
+	return reqKey, tokenKey, dayKey
+}
+
+func (rl *RateLimiter) checkAndIncrementGCRA(ctx context.Context, identity string, cfg Config, tokens int32) (*CheckResult, error) {
+	now := time.Now()
+
+	minutePeriod := time.Minute
+	dayPeriod := 24 * time.Hour
+
+	reqKey, tokenKey, dayKey := rl.gcraKeysFor(identity)
+
+	keys := []string{reqKey, tokenKey, dayKey}
+	args := []interface{}{
+		cfg.RequestsPerMinute,
+		cfg.TokensPerMinute,
+		cfg.RequestsPerDay,
+		int64(tokens),
+		now.UnixMilli(),
+		minutePeriod.Milliseconds(),
+		dayPeriod.Milliseconds(),
+	}
+
+	res, err := evalScript(ctx, rl.redis, rl.gcraScript, gcraCheckScript, keys, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate gcra script: %w", err)
+	}
+
+	rows, ok := res.([]interface{})
+	if !ok || len(rows) != 6 {
+		return nil, fmt.Errorf("unexpected script response: %v", res)
+	}
+
+	allowed := toInt64(rows[0]) == 1
+	reqUsed := int(toInt64(rows[1]))
+	tokensUsed := int(toInt64(rows[2]))
+	dayUsed := int(toInt64(rows[3]))
+	rejectionCode := toInt64(rows[4])
+	retryAfter := time.Duration(toInt64(rows[5])) * time.Millisecond
+
+	result := &CheckResult{
+		Allowed:         allowed,
+		CurrentRequests: reqUsed,
+		CurrentTokens:   tokensUsed,
+		CurrentDayReqs:  dayUsed,
+	}
+
+	reason := ""
+	switch rejectionCode {
+	case 1:
+		reason = "requests_per_minute"
+		result.RejectionReason = fmt.Sprintf("requests per minute limit exceeded (%d/%d)",
+			reqUsed, cfg.RequestsPerMinute)
+		result.ResetMinute = retryAfter
+	case 2:
+		reason = "tokens_per_minute"
+		result.RejectionReason = fmt.Sprintf("tokens per minute limit exceeded (%d+%d > %d)",
+			tokensUsed, tokens, cfg.TokensPerMinute)
+		result.ResetMinute = retryAfter
+	case 3:
+		reason = "requests_per_day"
+		result.RejectionReason = fmt.Sprintf("requests per day limit exceeded (%d/%d)",
+			dayUsed, cfg.RequestsPerDay)
+		result.ResetDay = retryAfter
+	}
+	rl.metrics.observeCheck(allowed, reason, tokens)
+
+	return result, nil
+}
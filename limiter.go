@@ -6,19 +6,62 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 )
 
+// Algorithm selects how CheckAndIncrement admits requests.
+type Algorithm string
+
+const (
+	// AlgorithmFixedWindow buckets requests into calendar minute/day
+	// windows (the original behavior). Simple, but allows up to 2x the
+	// configured rate across a window boundary.
+	AlgorithmFixedWindow Algorithm = "fixed-window"
+
+	// AlgorithmGCRA uses the Generic Cell Rate Algorithm to smooth
+	// admission over each window instead of resetting at a boundary.
+	AlgorithmGCRA Algorithm = "gcra"
+)
+
 type Config struct {
 	RequestsPerMinute int
 	TokensPerMinute   int
 	RequestsPerDay    int
+
+	// Limits, if set, replaces RequestsPerMinute/TokensPerMinute/
+	// RequestsPerDay with an arbitrary set of windows (e.g. per-second,
+	// per-hour) checked atomically by CheckAndIncrement. Leave unset to
+	// keep using the three fields above, which expand into three
+	// WindowLimits under the hood (see resolvedLimits). Only used by
+	// AlgorithmFixedWindow.
+	Limits []WindowLimit
+
+	// Algorithm selects the admission strategy. Defaults to
+	// AlgorithmFixedWindow when left zero-valued.
+	Algorithm Algorithm
+
+	// PerIdentity overrides the limits above for specific identities passed
+	// to the *For methods, e.g. per API key or per tenant. Identities not
+	// present here fall back to the top-level limits.
+	PerIdentity map[string]Config
+
+	// Metrics, if set, registers Prometheus instruments on registry and
+	// records check/usage/Redis-error observability for this limiter.
+	Metrics *prometheus.Registry
 }
 
 type RateLimiter struct {
 	redis  *redis.Client
 	config Config
 	prefix string
+
+	windowsScript   *scriptCache
+	windowsRollback *scriptCache
+	gcraScript      *scriptCache
+	gcraRollback    *scriptCache
+
+	metrics *metricsCollector
 }
 
 type CheckResult struct {
@@ -29,135 +72,123 @@ type CheckResult struct {
 	ResetMinute     time.Duration
 	ResetDay        time.Duration
 	RejectionReason string
+
+	// PerWindow reports current usage and time-to-reset for every window
+	// in the effective Config.Limits, keyed by WindowLimit.Name. The
+	// legacy fields above are populated from the "minute-requests",
+	// "minute-tokens" and "day-requests" sugar windows when present.
+	PerWindow map[string]WindowUsage
 }
 
 func New(redisClient *redis.Client, config Config) *RateLimiter {
+	mc := newMetricsCollector(config.Metrics)
+
+	installRedisErrorHookOnce(redisClient, mc)
+
 	return &RateLimiter{
-		redis:  redisClient,
-		config: config,
-		prefix: "gemini:ratelimit",
+		redis:           redisClient,
+		config:          config,
+		prefix:          "gemini:ratelimit",
+		windowsScript:   &scriptCache{},
+		windowsRollback: &scriptCache{},
+		gcraScript:      &scriptCache{},
+		gcraRollback:    &scriptCache{},
+		metrics:         mc,
 	}
 }
 
 func (rl *RateLimiter) CheckAndIncrement(ctx context.Context, tokens int32) (*CheckResult, error) {
-	now := time.Now()
-
-	minuteKey := fmt.Sprintf("%s:minute:%s", rl.prefix, now.Format("2006-01-02:15:04"))
-	minuteTokenKey := fmt.Sprintf("%s:tokens:minute:%s", rl.prefix, now.Format("2006-01-02:15:04"))
-	dayKey := fmt.Sprintf("%s:day:%s", rl.prefix, now.Format("2006-01-02"))
-
-	result := &CheckResult{
-		Allowed: true,
-	}
-
-	pipe := rl.redis.Pipeline()
-
-	minuteReqsCmd := pipe.Get(ctx, minuteKey)
-	minuteTokensCmd := pipe.Get(ctx, minuteTokenKey)
-	dayReqsCmd := pipe.Get(ctx, dayKey)
-
-	_, err := pipe.Exec(ctx)
-	if err != nil && err != redis.Nil {
-		return nil, fmt.Errorf("failed to get current values: %w", err)
-	}
-
-	currentMinuteReqs := parseIntOrZero(minuteReqsCmd.Val())
-	currentMinuteTokens := parseIntOrZero(minuteTokensCmd.Val())
-	currentDayReqs := parseIntOrZero(dayReqsCmd.Val())
-
-	result.CurrentRequests = currentMinuteReqs
-	result.CurrentTokens = currentMinuteTokens
-	result.CurrentDayReqs = currentDayReqs
-
-	if currentMinuteReqs >= rl.config.RequestsPerMinute {
-		result.Allowed = false
-		result.RejectionReason = fmt.Sprintf("requests per minute limit exceeded (%d/%d)",
-			currentMinuteReqs, rl.config.RequestsPerMinute)
-		result.ResetMinute = time.Until(now.Truncate(time.Minute).Add(time.Minute))
-		return result, nil
-	}
-
-	if currentMinuteTokens+int(tokens) > rl.config.TokensPerMinute {
-		result.Allowed = false
-		result.RejectionReason = fmt.Sprintf("tokens per minute limit exceeded (%d+%d > %d)",
-			currentMinuteTokens, tokens, rl.config.TokensPerMinute)
-		result.ResetMinute = time.Until(now.Truncate(time.Minute).Add(time.Minute))
-		return result, nil
-	}
-
-	if currentDayReqs >= rl.config.RequestsPerDay {
-		result.Allowed = false
-		result.RejectionReason = fmt.Sprintf("requests per day limit exceeded (%d/%d)",
-			currentDayReqs, rl.config.RequestsPerDay)
-		result.ResetDay = time.Until(now.Truncate(24 * time.Hour).Add(24 * time.Hour))
-		return result, nil
-	}
-
-	pipe = rl.redis.Pipeline()
-
-	pipe.Incr(ctx, minuteKey)
-	pipe.Expire(ctx, minuteKey, 2*time.Minute)
-
-	pipe.IncrBy(ctx, minuteTokenKey, int64(tokens))
-	pipe.Expire(ctx, minuteTokenKey, 2*time.Minute)
+	return rl.CheckAndIncrementFor(ctx, "", tokens)
+}
 
-	pipe.Incr(ctx, dayKey)
-	pipe.Expire(ctx, dayKey, 25*time.Hour)
+// CheckAndIncrementFor is CheckAndIncrement scoped to a single identity,
+// e.g. an API key, user ID or tenant. identity == "" behaves exactly like
+// CheckAndIncrement, sharing the global bucket. The limits applied are
+// Config.PerIdentity[identity] if present, otherwise the top-level Config.
+func (rl *RateLimiter) CheckAndIncrementFor(ctx context.Context, identity string, tokens int32) (*CheckResult, error) {
+	cfg := rl.configFor(identity)
 
-	_, err = pipe.Exec(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to increment counters: %w", err)
+	if cfg.Algorithm == AlgorithmGCRA {
+		return rl.checkAndIncrementGCRA(ctx, identity, cfg, tokens)
 	}
 
-	result.CurrentRequests++
-	result.CurrentTokens += int(tokens)
-	result.CurrentDayReqs++
-	result.ResetMinute = time.Until(now.Truncate(time.Minute).Add(time.Minute))
-	result.ResetDay = time.Until(now.Truncate(24 * time.Hour).Add(24 * time.Hour))
-
-	return result, nil
+	return rl.checkAndIncrementWindows(ctx, identity, cfg, tokens)
 }
 
 func (rl *RateLimiter) GetCurrentUsage(ctx context.Context) (*CheckResult, error) {
+	return rl.GetCurrentUsageFor(ctx, "")
+}
+
+// GetCurrentUsageFor is GetCurrentUsage scoped to a single identity.
+func (rl *RateLimiter) GetCurrentUsageFor(ctx context.Context, identity string) (*CheckResult, error) {
+	cfg := rl.configFor(identity)
+	limits := resolvedLimits(cfg)
 	now := time.Now()
 
-	minuteKey := fmt.Sprintf("%s:minute:%s", rl.prefix, now.Format("2006-01-02:15:04"))
-	minuteTokenKey := fmt.Sprintf("%s:tokens:minute:%s", rl.prefix, now.Format("2006-01-02:15:04"))
-	dayKey := fmt.Sprintf("%s:day:%s", rl.prefix, now.Format("2006-01-02"))
+	keys, buckets := rl.windowKeysFor(identity, limits, now)
 
 	pipe := rl.redis.Pipeline()
-	minuteReqsCmd := pipe.Get(ctx, minuteKey)
-	minuteTokensCmd := pipe.Get(ctx, minuteTokenKey)
-	dayReqsCmd := pipe.Get(ctx, dayKey)
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
 
 	_, err := pipe.Exec(ctx)
 	if err != nil && err != redis.Nil {
 		return nil, fmt.Errorf("failed to get usage: %w", err)
 	}
 
-	result := &CheckResult{
-		CurrentRequests: parseIntOrZero(minuteReqsCmd.Val()),
-		CurrentTokens:   parseIntOrZero(minuteTokensCmd.Val()),
-		CurrentDayReqs:  parseIntOrZero(dayReqsCmd.Val()),
-		ResetMinute:     time.Until(now.Truncate(time.Minute).Add(time.Minute)),
-		ResetDay:        time.Until(now.Truncate(24 * time.Hour).Add(24 * time.Hour)),
+	perWindow := make(map[string]WindowUsage, len(limits))
+	for i, limit := range limits {
+		perWindow[limit.Name] = WindowUsage{
+			Requests: parseIntOrZero(cmds[i*2].Val()),
+			Tokens:   parseIntOrZero(cmds[i*2+1].Val()),
+			ResetIn:  time.Until(buckets[i].Add(limit.Window)),
+		}
 	}
 
+	result := &CheckResult{PerWindow: perWindow}
+	populateLegacyFields(result, perWindow)
+	rl.metrics.observeUsage(result)
+
 	return result, nil
 }
 
 func (rl *RateLimiter) Reset(ctx context.Context) error {
-	now := time.Now()
+	return rl.ResetFor(ctx, "")
+}
 
-	keys := []string{
-		fmt.Sprintf("%s:minute:%s", rl.prefix, now.Format("2006-01-02:15:04")),
-		fmt.Sprintf("%s:tokens:minute:%s", rl.prefix, now.Format("2006-01-02:15:04")),
-		fmt.Sprintf("%s:day:%s", rl.prefix, now.Format("2006-01-02")),
-	}
+// ResetFor is Reset scoped to a single identity.
+func (rl *RateLimiter) ResetFor(ctx context.Context, identity string) error {
+	cfg := rl.configFor(identity)
+	limits := resolvedLimits(cfg)
+
+	keys, _ := rl.windowKeysFor(identity, limits, time.Now())
 
 	return rl.redis.Del(ctx, keys...).Err()
 }
 
+// keyPrefixFor folds identity into the key prefix. identity == "" keeps the
+// original, un-scoped key shape so existing callers see no key migration.
+func (rl *RateLimiter) keyPrefixFor(identity string) string {
+	if identity == "" {
+		return rl.prefix
+	}
+	return fmt.Sprintf("%s:id:%s", rl.prefix, identity)
+}
+
+// configFor resolves the effective limits for identity, falling back to the
+// top-level Config when identity has no PerIdentity override.
+func (rl *RateLimiter) configFor(identity string) Config {
+	if identity == "" {
+		return rl.config
+	}
+	if cfg, ok := rl.config.PerIdentity[identity]; ok {
+		return cfg
+	}
+	return rl.config
+}
+
 func parseIntOrZero(s string) int {
 	if s == "" {
 		return 0
@@ -168,3 +199,14 @@ func parseIntOrZero(s string) int {
 	}
 	return val
 }
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	default:
+		return 0
+	}
+}
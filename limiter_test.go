@@ -2,8 +2,11 @@ package ratelimiter
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -53,6 +56,48 @@ func TestRateLimiter_RequestsPerMinute(t *testing.T) {
 	assert.Contains(t, result.RejectionReason, "requests per minute")
 }
 
+// TestRateLimiter_ConcurrentRequestsAreAtomic drives many concurrent callers
+// against a small RequestsPerMinute budget and checks that exactly that many
+// are admitted, proving the check and the increment happen atomically. A
+// read-then-write race would let concurrent callers all observe room and
+// over-admit past the limit.
+func TestRateLimiter_ConcurrentRequestsAreAtomic(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	const limit = 10
+	const callers = 50
+
+	limiter := New(client, Config{
+		RequestsPerMinute: limit,
+		TokensPerMinute:   1000000,
+		RequestsPerDay:    1000000,
+	})
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := limiter.CheckAndIncrement(ctx, 1)
+			require.NoError(t, err)
+			if result.Allowed {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, limit, admitted)
+}
+
 func TestRateLimiter_TokensPerMinute(t *testing.T) {
 	client := setupTestRedis(t)
 	defer client.Close()
@@ -102,6 +147,353 @@ func TestRateLimiter_RequestsPerDay(t *testing.T) {
 	assert.Contains(t, result.RejectionReason, "requests per day")
 }
 
+// TestRateLimiter_PerIdentity checks that identities with a PerIdentity
+// override get their own independent bucket and limit, while an identity
+// with no override falls back to the top-level Config.
+func TestRateLimiter_PerIdentity(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		RequestsPerMinute: 100,
+		TokensPerMinute:   100000,
+		RequestsPerDay:    100000,
+		PerIdentity: map[string]Config{
+			"tenant-a": {
+				RequestsPerMinute: 1,
+				TokensPerMinute:   100000,
+				RequestsPerDay:    100000,
+			},
+		},
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrementFor(ctx, "tenant-a", 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.CheckAndIncrementFor(ctx, "tenant-a", 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "tenant-a should be limited by its own override")
+
+	result, err = limiter.CheckAndIncrementFor(ctx, "tenant-b", 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "tenant-b has no override and should use the top-level limits")
+}
+
+// TestRateLimiter_GCRA checks basic admission under the GCRA algorithm:
+// requests are admitted up to the per-minute rate and rejected past it.
+func TestRateLimiter_GCRA(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		Algorithm:         AlgorithmGCRA,
+		RequestsPerMinute: 2,
+		TokensPerMinute:   1000,
+		RequestsPerDay:    100,
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrement(ctx, 10)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.CheckAndIncrement(ctx, 10)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.CheckAndIncrement(ctx, 10)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Contains(t, result.RejectionReason, "requests per minute")
+}
+
+// TestRateLimiter_GCRA_UnsetLimitBlocks makes sure leaving one of the three
+// GCRA dimensions at its Go zero value (an easy mistake, since Config has
+// no validation) doesn't divide by zero, and that the dimension fails
+// closed (blocks every request) rather than becoming unenforced, matching
+// the windows engine's default-deny behavior for the same mistake.
+func TestRateLimiter_GCRA_UnsetLimitBlocks(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		Algorithm:         AlgorithmGCRA,
+		RequestsPerMinute: 100,
+		TokensPerMinute:   100000,
+		// RequestsPerDay intentionally left unset.
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Contains(t, result.RejectionReason, "requests per day")
+	assert.Greater(t, result.ResetDay, time.Duration(0))
+}
+
+// TestRateLimiter_ReserveCancelRoundTrip checks that canceling a reservation
+// gives back the exact slot it consumed, even after the fixed window it was
+// reserved in has since rolled over and a new window has started.
+func TestRateLimiter_ReserveCancelRoundTrip(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		RequestsPerMinute: 1,
+		TokensPerMinute:   1000,
+		RequestsPerDay:    1000,
+	})
+
+	ctx := context.Background()
+
+	res, err := limiter.Reserve(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, res.allowed)
+
+	usage, err := limiter.GetCurrentUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.CurrentRequests)
+
+	// Simulate the reservation's window having rolled over by the time
+	// Cancel runs: rewrite its captured keys to belong to the previous
+	// window, the same way a real clock tick across a boundary would.
+	for i, key := range res.keys {
+		res.keys[i] = key + ":simulated-previous-window"
+	}
+	require.NoError(t, client.Set(ctx, res.keys[0], 1, 0).Err())
+
+	require.NoError(t, res.Cancel(ctx))
+
+	// The *current* window's usage must be untouched: Cancel must not have
+	// decremented whatever window time.Now() resolves to right now.
+	usage, err = limiter.GetCurrentUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.CurrentRequests)
+
+	// The simulated previous window's counter is what Cancel should have
+	// rolled back.
+	val, err := client.Get(ctx, res.keys[0]).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 0, val)
+}
+
+// TestRateLimiter_GCRA_ReserveCancelRoundTrip checks that canceling a GCRA
+// reservation gives back its consumed slot, so the next check is admitted
+// again.
+func TestRateLimiter_GCRA_ReserveCancelRoundTrip(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		Algorithm:         AlgorithmGCRA,
+		RequestsPerMinute: 1,
+		TokensPerMinute:   1000,
+		RequestsPerDay:    1000,
+	})
+
+	ctx := context.Background()
+
+	res, err := limiter.Reserve(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, res.allowed)
+
+	result, err := limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "the single request/minute slot should already be consumed")
+
+	require.NoError(t, res.Cancel(ctx))
+
+	result, err = limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "canceling the reservation should give the slot back")
+}
+
+// TestRateLimiter_Metrics checks that a configured registry observes check
+// results, and that a second RateLimiter sharing the same registry (a
+// pattern PerIdentity setups encourage) doesn't panic on registration.
+func TestRateLimiter_Metrics(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	registry := prometheus.NewRegistry()
+
+	limiter := New(client, Config{
+		RequestsPerMinute: 1,
+		TokensPerMinute:   1000,
+		RequestsPerDay:    1000,
+		Metrics:           registry,
+	})
+
+	assert.NotPanics(t, func() {
+		New(client, Config{
+			RequestsPerMinute: 1,
+			TokensPerMinute:   1000,
+			RequestsPerDay:    1000,
+			Metrics:           registry,
+		})
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+
+	result, err = limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+
+	metricFamilies, err := registry.Gather()
+	require.NoError(t, err)
+
+	var sawAllowed, sawRejected bool
+	for _, mf := range metricFamilies {
+		if mf.GetName() != "ratelimit_requests_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() == "allowed" {
+					sawAllowed = true
+				}
+				if l.GetName() == "result" && l.GetValue() == "rejected" {
+					sawRejected = true
+				}
+			}
+		}
+	}
+	assert.True(t, sawAllowed, "expected an allowed check to be observed")
+	assert.True(t, sawRejected, "expected a rejected check to be observed")
+}
+
+// TestRateLimiter_SharedClientLaterMetricsAreAdopted checks that when the
+// first RateLimiter built on a client has no Config.Metrics (so it installs
+// a no-op hook), a later RateLimiter sharing that client *with* metrics
+// configured still gets its Redis errors recorded, instead of silently
+// reporting nothing because the client already looked "hooked".
+func TestRateLimiter_SharedClientLaterMetricsAreAdopted(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	hookedClients.Delete(client)
+
+	New(client, Config{RequestsPerMinute: 1}) // no metrics
+
+	registry := prometheus.NewRegistry()
+	New(client, Config{RequestsPerMinute: 1, Metrics: registry})
+
+	v, ok := hookedClients.Load(client)
+	require.True(t, ok)
+	hook := v.(*redisErrorHook)
+
+	hook.mu.Lock()
+	mc := hook.metrics
+	hook.mu.Unlock()
+	require.NotNil(t, mc, "the second limiter's metrics collector should have been adopted onto the shared hook")
+
+	hook.incRedisError("test")
+
+	metricFamilies, err := registry.Gather()
+	require.NoError(t, err)
+
+	var sawError bool
+	for _, mf := range metricFamilies {
+		if mf.GetName() == "ratelimit_redis_errors_total" {
+			sawError = true
+		}
+	}
+	assert.True(t, sawError, "expected the adopted collector to observe the Redis error")
+}
+
+// TestRateLimiter_SharedClientHookIsInstalledOnce checks that building
+// multiple RateLimiters on one shared *redis.Client only installs the Redis
+// error hook once, so Redis errors aren't double/triple counted.
+func TestRateLimiter_SharedClientHookIsInstalledOnce(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	hookedClients.Delete(client)
+
+	registry := prometheus.NewRegistry()
+
+	New(client, Config{RequestsPerMinute: 1, Metrics: registry})
+	New(client, Config{RequestsPerMinute: 1, Metrics: registry})
+	New(client, Config{RequestsPerMinute: 1, Metrics: registry})
+
+	_, alreadyHooked := hookedClients.Load(client)
+	assert.True(t, alreadyHooked)
+
+	// One failing command must be counted once, not once per limiter.
+	err := client.Do(context.Background(), "ratelimiter-test-unknown-command").Err()
+	require.Error(t, err)
+
+	metricFamilies, err := registry.Gather()
+	require.NoError(t, err)
+
+	var redisErrors float64
+	for _, mf := range metricFamilies {
+		if mf.GetName() != "ratelimit_redis_errors_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			redisErrors += m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, float64(1), redisErrors)
+}
+
+// TestRateLimiter_CustomLimits checks that Config.Limits can describe a
+// window shape the legacy fields can't (a per-second burst window).
+func TestRateLimiter_CustomLimits(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		Limits: []WindowLimit{
+			{Name: "second-requests", Window: time.Second, MaxRequests: 1, MaxTokens: -1},
+		},
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Contains(t, result.RejectionReason, "second-requests")
+}
+
+// TestRateLimiter_UnsetLegacyFieldBlocks checks that leaving a legacy
+// RequestsPerMinute/TokensPerMinute/RequestsPerDay field at its Go zero
+// value blocks that dimension, matching the original fixed-window
+// limiter's fail-closed behavior, rather than silently becoming
+// unenforced.
+func TestRateLimiter_UnsetLegacyFieldBlocks(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	limiter := New(client, Config{
+		RequestsPerMinute: 100,
+		TokensPerMinute:   100000,
+		// RequestsPerDay intentionally left unset.
+	})
+
+	ctx := context.Background()
+
+	result, err := limiter.CheckAndIncrement(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Contains(t, result.RejectionReason, "requests per day")
+}
+
 func TestRateLimiter_GetCurrentUsage(t *testing.T) {
 	client := setupTestRedis(t)
 	defer client.Close()
@@ -0,0 +1,215 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// metricsCollector holds the Prometheus instruments registered for a
+// RateLimiter when Config.Metrics is set. A nil *metricsCollector disables
+// all observation calls, so callers never need to nil-check Config.Metrics
+// themselves.
+type metricsCollector struct {
+	requestsTotal  *prometheus.CounterVec
+	tokensConsumed prometheus.Counter
+	currentUsage   *prometheus.GaugeVec
+	redisErrors    *prometheus.CounterVec
+}
+
+func newMetricsCollector(registry *prometheus.Registry) *metricsCollector {
+	if registry == nil {
+		return nil
+	}
+
+	mc := &metricsCollector{
+		requestsTotal: registerOrReuseCounterVec(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_requests_total",
+			Help: "Total rate limit checks, partitioned by result and rejection reason.",
+		}, []string{"result", "reason"})),
+		tokensConsumed: registerOrReuseCounter(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimit_tokens_consumed_total",
+			Help: "Total tokens consumed by admitted requests.",
+		})),
+		currentUsage: registerOrReuseGaugeVec(registry, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ratelimit_current_usage",
+			Help: "Current usage per window and kind, refreshed by GetCurrentUsage.",
+		}, []string{"window", "kind"})),
+		redisErrors: registerOrReuseCounterVec(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_redis_errors_total",
+			Help: "Total Redis errors encountered by the rate limiter, partitioned by operation.",
+		}, []string{"op"})),
+	}
+
+	return mc
+}
+
+// registerOrReuseCounterVec registers cv, or, if registry already has a
+// collector under the same name (e.g. a second RateLimiter sharing one
+// registry across identities/tenants), returns that existing collector
+// instead of panicking like MustRegister would.
+func registerOrReuseCounterVec(registry *prometheus.Registry, cv *prometheus.CounterVec) *prometheus.CounterVec {
+	err := registry.Register(cv)
+	if err == nil {
+		return cv
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(*prometheus.CounterVec); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
+
+func registerOrReuseCounter(registry *prometheus.Registry, c prometheus.Counter) prometheus.Counter {
+	err := registry.Register(c)
+	if err == nil {
+		return c
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(prometheus.Counter); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
+
+func registerOrReuseGaugeVec(registry *prometheus.Registry, gv *prometheus.GaugeVec) *prometheus.GaugeVec {
+	err := registry.Register(gv)
+	if err == nil {
+		return gv
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(*prometheus.GaugeVec); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
+
+func (m *metricsCollector) observeCheck(allowed bool, reason string, tokens int32) {
+	if m == nil {
+		return
+	}
+
+	if allowed {
+		m.requestsTotal.WithLabelValues("allowed", "").Inc()
+		m.tokensConsumed.Add(float64(tokens))
+		return
+	}
+
+	m.requestsTotal.WithLabelValues("rejected", reason).Inc()
+}
+
+func (m *metricsCollector) observeUsage(result *CheckResult) {
+	if m == nil {
+		return
+	}
+
+	m.currentUsage.WithLabelValues("minute", "requests").Set(float64(result.CurrentRequests))
+	m.currentUsage.WithLabelValues("minute", "tokens").Set(float64(result.CurrentTokens))
+	m.currentUsage.WithLabelValues("day", "requests").Set(float64(result.CurrentDayReqs))
+}
+
+func (m *metricsCollector) incRedisError(op string) {
+	if m == nil {
+		return
+	}
+	m.redisErrors.WithLabelValues(op).Inc()
+}
+
+// redisErrorHook wires Redis connection and command errors into the
+// configured metrics, and logs reconnects. go-redis v9 dropped its
+// built-in reconnect/metrics hook, so every consumer of this package
+// gets one installed for free instead of having to wire its own.
+//
+// metrics is guarded by mu rather than set once at construction: the hook
+// is shared across every RateLimiter built on the same client (see
+// installRedisErrorHookOnce), and the first of those limiters to exist
+// may have had Config.Metrics unset.
+type redisErrorHook struct {
+	mu      sync.Mutex
+	metrics *metricsCollector
+}
+
+// adoptMetrics lets a later RateLimiter on an already-hooked client wire up
+// its collector if the hook doesn't have one yet. The first non-nil
+// collector offered wins; a client shared by limiters with two different
+// registries only ever reports through the first one, same as the
+// single-collector case already does.
+func (h *redisErrorHook) adoptMetrics(mc *metricsCollector) {
+	if mc == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.metrics == nil {
+		h.metrics = mc
+	}
+}
+
+func (h *redisErrorHook) incRedisError(op string) {
+	h.mu.Lock()
+	mc := h.metrics
+	h.mu.Unlock()
+	mc.incRedisError(op)
+}
+
+// hookedClients tracks the redisErrorHook already installed on each
+// *redis.Client. go-redis hooks are additive, not idempotent, so without
+// this a client shared across multiple RateLimiters (a pattern PerIdentity
+// encourages) would accumulate one hook per limiter and each Redis error
+// would be observed/logged once per accumulated hook. Only the first
+// RateLimiter built against a given client installs the hook; later
+// limiters on the same client adopt their metrics onto that same hook
+// instead of installing their own.
+var hookedClients sync.Map // map[*redis.Client]*redisErrorHook
+
+func installRedisErrorHookOnce(client *redis.Client, mc *metricsCollector) {
+	v, loaded := hookedClients.LoadOrStore(client, &redisErrorHook{metrics: mc})
+	if loaded {
+		v.(*redisErrorHook).adoptMetrics(mc)
+		return
+	}
+	client.AddHook(v.(*redisErrorHook))
+}
+
+func (h *redisErrorHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			h.incRedisError("dial")
+			return conn, err
+		}
+		log.Printf("ratelimiter: connected to redis at %s", addr)
+		return conn, err
+	}
+}
+
+func (h *redisErrorHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if err != nil && err != redis.Nil {
+			h.incRedisError(cmd.Name())
+		}
+		return err
+	}
+}
+
+func (h *redisErrorHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		if err != nil && err != redis.Nil {
+			h.incRedisError("pipeline")
+		}
+		return err
+	}
+}
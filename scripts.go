@@ -0,0 +1,52 @@
+package ratelimiter
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptCache caches the SHA1 of a loaded script so steady-state calls can
+// use the cheaper EVALSHA, falling back to EVAL (and reloading the SHA)
+// whenever Redis reports NOSCRIPT, e.g. after a FLUSHALL or failover.
+type scriptCache struct {
+	mu  sync.RWMutex
+	sha string
+}
+
+func (c *scriptCache) get() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sha
+}
+
+func (c *scriptCache) set(sha string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sha = sha
+}
+
+func evalScript(ctx context.Context, client *redis.Client, cache *scriptCache, source string, keys []string, args ...interface{}) (interface{}, error) {
+	if sha := cache.get(); sha != "" {
+		res, err := client.EvalSha(ctx, sha, keys, args...).Result()
+		if err == nil || !isNoScriptErr(err) {
+			return res, err
+		}
+	}
+
+	// EVAL also loads source into Redis's script cache, so its SHA1 is
+	// valid for EVALSHA on the next call.
+	sum := sha1.Sum([]byte(source))
+	res, err := client.Eval(ctx, source, keys, args...).Result()
+	cache.set(hex.EncodeToString(sum[:]))
+
+	return res, err
+}
+
+func isNoScriptErr(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
@@ -0,0 +1,200 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// gcraRollbackScript undoes a GCRA reservation by subtracting the same
+// cost*emission increment CheckAndIncrement added to each tat.
+//
+// KEYS: [1] request tat key, [2] token tat key, [3] day-request tat key
+// ARGV: [1] requests-per-minute limit, [2] tokens-per-minute limit,
+//
+//	[3] requests-per-day limit, [4] token cost, [5] minute period (millis),
+//	[6] day period (millis)
+//
+// Periods are millisecond-resolution to match gcraCheckScript's clock.
+const gcraRollbackScript = `
+local function rollback(key, limit, cost, period)
+	if limit <= 0 then
+		-- A zero limit blocks every request in gcraCheckScript, so no
+		-- admitted reservation ever wrote to this key.
+		return
+	end
+	local tat = tonumber(redis.call('GET', key))
+	if not tat then
+		return
+	end
+	local emission = period / limit
+	local new_tat = tat - cost * emission
+	redis.call('SET', key, new_tat, 'PX', period)
+end
+
+rollback(KEYS[1], tonumber(ARGV[1]), 1, tonumber(ARGV[5]))
+rollback(KEYS[2], tonumber(ARGV[2]), tonumber(ARGV[4]), tonumber(ARGV[5]))
+rollback(KEYS[3], tonumber(ARGV[3]), 1, tonumber(ARGV[6]))
+
+return 1
+`
+
+// Wait is WaitFor scoped to the default, un-scoped identity.
+func (rl *RateLimiter) Wait(ctx context.Context, tokens int32) (*CheckResult, error) {
+	return rl.WaitFor(ctx, "", tokens)
+}
+
+// WaitFor blocks until tokens can be admitted for identity, retrying
+// CheckAndIncrementFor with a jittered backoff between attempts. It returns
+// as soon as a check succeeds, or when ctx is done.
+func (rl *RateLimiter) WaitFor(ctx context.Context, identity string, tokens int32) (*CheckResult, error) {
+	for {
+		result, err := rl.CheckAndIncrementFor(ctx, identity, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if result.Allowed {
+			return result, nil
+		}
+
+		delay := minPositiveDuration(result.ResetMinute, result.ResetDay)
+		if delay <= 0 {
+			delay = time.Second
+		}
+		delay += jitter(delay)
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Reservation is the outcome of Reserve/ReserveFor. An admitted reservation
+// has already consumed its slot, and Cancel gives the slot back if the work
+// it was reserved for never happens. A rejected reservation consumes and
+// holds nothing: Delay() reports how long to wait before trying again, and
+// no slot is set aside for that later time.
+type Reservation struct {
+	limiter  *RateLimiter
+	identity string
+	cfg      Config
+	tokens   int32
+	allowed  bool
+	delay    time.Duration
+
+	// keys are the exact window keys this reservation checked/incremented,
+	// captured at reservation time. Only used for the windows algorithm:
+	// its keys are time-bucketed, so Cancel must roll back these keys
+	// specifically rather than recomputing them against time.Now(), which
+	// would target the wrong window after a boundary has passed. GCRA keys
+	// never rotate, so its rollback recomputes them fine.
+	keys []string
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Delay reports how long the caller should wait before trying again after
+// a rejected reservation. It is zero when the reservation was admitted.
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+// Cancel gives back the counters this reservation consumed. It is a no-op
+// if the reservation was never admitted, or has already been canceled.
+func (r *Reservation) Cancel(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.canceled || !r.allowed {
+		return nil
+	}
+	r.canceled = true
+
+	return r.limiter.rollback(ctx, r.identity, r.cfg, r.tokens, r.keys)
+}
+
+// Reserve is ReserveFor scoped to the default, un-scoped identity.
+func (rl *RateLimiter) Reserve(ctx context.Context, tokens int32) (*Reservation, error) {
+	return rl.ReserveFor(ctx, "", tokens)
+}
+
+// ReserveFor checks and, if admitted, consumes tokens for identity, handing
+// back a Reservation the caller can Cancel to release them again. Unlike
+// Wait, it never blocks: a rejected reservation simply reports the delay
+// the caller would need to wait before trying again.
+func (rl *RateLimiter) ReserveFor(ctx context.Context, identity string, tokens int32) (*Reservation, error) {
+	cfg := rl.configFor(identity)
+
+	var result *CheckResult
+	var keys []string
+	var err error
+	if cfg.Algorithm == AlgorithmGCRA {
+		result, err = rl.checkAndIncrementGCRA(ctx, identity, cfg, tokens)
+	} else {
+		result, keys, err = rl.checkAndIncrementWindowsKeyed(ctx, identity, cfg, tokens)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Reservation{
+		limiter:  rl,
+		identity: identity,
+		cfg:      cfg,
+		tokens:   tokens,
+		allowed:  result.Allowed,
+		keys:     keys,
+	}
+	if !result.Allowed {
+		res.delay = minPositiveDuration(result.ResetMinute, result.ResetDay)
+	}
+
+	return res, nil
+}
+
+func (rl *RateLimiter) rollback(ctx context.Context, identity string, cfg Config, tokens int32, keys []string) error {
+	if cfg.Algorithm == AlgorithmGCRA {
+		reqKey, tokenKey, dayKey := rl.gcraKeysFor(identity)
+
+		_, err := evalScript(ctx, rl.redis, rl.gcraRollback, gcraRollbackScript,
+			[]string{reqKey, tokenKey, dayKey},
+			cfg.RequestsPerMinute, cfg.TokensPerMinute, cfg.RequestsPerDay, int64(tokens),
+			time.Minute.Milliseconds(), (24 * time.Hour).Milliseconds(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to roll back gcra reservation: %w", err)
+		}
+		return nil
+	}
+
+	return rl.rollbackWindows(ctx, cfg, tokens, keys)
+}
+
+func minPositiveDuration(a, b time.Duration) time.Duration {
+	switch {
+	case a > 0 && b > 0:
+		if a < b {
+			return a
+		}
+		return b
+	case a > 0:
+		return a
+	case b > 0:
+		return b
+	default:
+		return 0
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	max := d / 10
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,273 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WindowLimit describes one admission window: up to MaxRequests requests
+// and/or MaxTokens tokens may be consumed within Window before the window
+// resets. A negative MaxRequests/MaxTokens means that dimension is not
+// enforced for this window (it is still tracked and reported). A zero
+// value is enforced and blocks every request in that dimension, matching
+// the original fixed-window limiter's fail-closed behavior for a legacy
+// RequestsPerMinute/TokensPerMinute/RequestsPerDay field left unset.
+type WindowLimit struct {
+	Name        string
+	Window      time.Duration
+	MaxRequests int
+	MaxTokens   int
+}
+
+// WindowUsage reports current consumption for a single WindowLimit.
+type WindowUsage struct {
+	Requests int
+	Tokens   int
+	ResetIn  time.Duration
+}
+
+// resolvedLimits returns cfg.Limits verbatim when set, otherwise expands
+// the legacy RequestsPerMinute/TokensPerMinute/RequestsPerDay fields into
+// their WindowLimit equivalents so existing callers keep working unchanged.
+// Each sugar window only ever checked one dimension, so the other dimension
+// is set to -1 (not enforced) rather than left at its Go zero value, which
+// would otherwise be indistinguishable from a caller genuinely leaving a
+// legacy field unset (and which must keep blocking, per WindowLimit's doc).
+func resolvedLimits(cfg Config) []WindowLimit {
+	if len(cfg.Limits) > 0 {
+		return cfg.Limits
+	}
+
+	return []WindowLimit{
+		{Name: "minute-requests", Window: time.Minute, MaxRequests: cfg.RequestsPerMinute, MaxTokens: -1},
+		{Name: "minute-tokens", Window: time.Minute, MaxRequests: -1, MaxTokens: cfg.TokensPerMinute},
+		{Name: "day-requests", Window: 24 * time.Hour, MaxRequests: cfg.RequestsPerDay, MaxTokens: -1},
+	}
+}
+
+// windowsCheckScript checks an arbitrary number of windows atomically,
+// reading and (if every window admits) incrementing a
+// request counter and a token counter per window in one round trip.
+//
+// KEYS: [requests_1, tokens_1, requests_2, tokens_2, ...] (2 per window)
+// ARGV: [1] window count, [2] token cost, then per window:
+//
+//	maxRequests, maxTokens, ttlSeconds
+//
+// Returns {allowed (0/1), violatedWindow (1-based, 0 if allowed),
+// violatedDimension (1=requests, 2=tokens), requestCounts[], tokenCounts[]}.
+const windowsCheckScript = `
+local n = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+
+local reqCounts = {}
+local tokCounts = {}
+local maxReqs = {}
+local maxToks = {}
+local ttls = {}
+
+for i = 1, n do
+	local reqKey = KEYS[(i - 1) * 2 + 1]
+	local tokKey = KEYS[(i - 1) * 2 + 2]
+	reqCounts[i] = tonumber(redis.call('GET', reqKey)) or 0
+	tokCounts[i] = tonumber(redis.call('GET', tokKey)) or 0
+
+	local base = 3 + (i - 1) * 3
+	maxReqs[i] = tonumber(ARGV[base])
+	maxToks[i] = tonumber(ARGV[base + 1])
+	ttls[i] = tonumber(ARGV[base + 2])
+end
+
+for i = 1, n do
+	if maxReqs[i] >= 0 and reqCounts[i] >= maxReqs[i] then
+		return {0, i, 1, reqCounts, tokCounts}
+	end
+	if maxToks[i] >= 0 and tokCounts[i] + cost > maxToks[i] then
+		return {0, i, 2, reqCounts, tokCounts}
+	end
+end
+
+for i = 1, n do
+	local reqKey = KEYS[(i - 1) * 2 + 1]
+	local tokKey = KEYS[(i - 1) * 2 + 2]
+	reqCounts[i] = redis.call('INCR', reqKey)
+	redis.call('EXPIRE', reqKey, ttls[i])
+	tokCounts[i] = redis.call('INCRBY', tokKey, cost)
+	redis.call('EXPIRE', tokKey, ttls[i])
+end
+
+return {1, 0, 0, reqCounts, tokCounts}
+`
+
+// windowsRollbackScript gives back one reservation's worth of usage across
+// every window, decrementing each request counter by 1 and each token
+// counter by the token cost, clamping both at zero.
+//
+// KEYS: [requests_1, tokens_1, requests_2, tokens_2, ...]
+// ARGV: [1] window count, [2] token cost
+const windowsRollbackScript = `
+local n = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+
+for i = 1, n do
+	local reqKey = KEYS[(i - 1) * 2 + 1]
+	local tokKey = KEYS[(i - 1) * 2 + 2]
+
+	local r = (tonumber(redis.call('GET', reqKey)) or 0) - 1
+	if r < 0 then r = 0 end
+	redis.call('SET', reqKey, r, 'KEEPTTL')
+
+	local t = (tonumber(redis.call('GET', tokKey)) or 0) - cost
+	if t < 0 then t = 0 end
+	redis.call('SET', tokKey, t, 'KEEPTTL')
+end
+
+return 1
+`
+
+// windowKeysFor builds the 2-per-window [requests, tokens] key list plus
+// each window's current bucket start, so callers can compute ResetIn.
+func (rl *RateLimiter) windowKeysFor(identity string, limits []WindowLimit, now time.Time) (keys []string, buckets []time.Time) {
+	prefix := rl.keyPrefixFor(identity)
+
+	keys = make([]string, 0, len(limits)*2)
+	buckets = make([]time.Time, len(limits))
+
+	for i, limit := range limits {
+		bucket := now.Truncate(limit.Window)
+		buckets[i] = bucket
+
+		keys = append(keys,
+			fmt.Sprintf("%s:w:%s:req:%d", prefix, limit.Name, bucket.UnixNano()),
+			fmt.Sprintf("%s:w:%s:tok:%d", prefix, limit.Name, bucket.UnixNano()),
+		)
+	}
+
+	return keys, buckets
+}
+
+func (rl *RateLimiter) checkAndIncrementWindows(ctx context.Context, identity string, cfg Config, tokens int32) (*CheckResult, error) {
+	result, _, err := rl.checkAndIncrementWindowsKeyed(ctx, identity, cfg, tokens)
+	return result, err
+}
+
+// checkAndIncrementWindowsKeyed is checkAndIncrementWindows but also
+// returns the exact keys this call read/incremented, so a Reservation can
+// remember them and roll back the same time-bucketed keys later even if
+// the window has since rolled over (see rollbackWindows).
+func (rl *RateLimiter) checkAndIncrementWindowsKeyed(ctx context.Context, identity string, cfg Config, tokens int32) (*CheckResult, []string, error) {
+	limits := resolvedLimits(cfg)
+	now := time.Now()
+
+	keys, buckets := rl.windowKeysFor(identity, limits, now)
+
+	args := make([]interface{}, 0, 2+len(limits)*3)
+	args = append(args, len(limits), int64(tokens))
+	for _, limit := range limits {
+		ttl := int(limit.Window.Seconds()) + 60
+		args = append(args, limit.MaxRequests, limit.MaxTokens, ttl)
+	}
+
+	res, err := evalScript(ctx, rl.redis, rl.windowsScript, windowsCheckScript, keys, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to evaluate windows script: %w", err)
+	}
+
+	rows, ok := res.([]interface{})
+	if !ok || len(rows) != 5 {
+		return nil, nil, fmt.Errorf("unexpected script response: %v", res)
+	}
+
+	allowed := toInt64(rows[0]) == 1
+	violatedWindow := int(toInt64(rows[1]))
+	violatedDimension := toInt64(rows[2])
+	reqCounts, _ := rows[3].([]interface{})
+	tokCounts, _ := rows[4].([]interface{})
+
+	perWindow := make(map[string]WindowUsage, len(limits))
+	for i, limit := range limits {
+		perWindow[limit.Name] = WindowUsage{
+			Requests: int(toInt64(reqCounts[i])),
+			Tokens:   int(toInt64(tokCounts[i])),
+			ResetIn:  time.Until(buckets[i].Add(limit.Window)),
+		}
+	}
+
+	result := &CheckResult{Allowed: allowed, PerWindow: perWindow}
+	populateLegacyFields(result, perWindow)
+
+	reason := ""
+	if !allowed {
+		limit := limits[violatedWindow-1]
+		usage := perWindow[limit.Name]
+		reason = limit.Name
+
+		switch violatedDimension {
+		case 1:
+			result.RejectionReason = rejectionReasonForRequests(limit, usage.Requests)
+		case 2:
+			result.RejectionReason = rejectionReasonForTokens(limit, usage.Tokens, tokens)
+		}
+	}
+	rl.metrics.observeCheck(allowed, reason, tokens)
+
+	return result, keys, nil
+}
+
+func rejectionReasonForRequests(limit WindowLimit, current int) string {
+	switch limit.Name {
+	case "minute-requests":
+		return fmt.Sprintf("requests per minute limit exceeded (%d/%d)", current, limit.MaxRequests)
+	case "day-requests":
+		return fmt.Sprintf("requests per day limit exceeded (%d/%d)", current, limit.MaxRequests)
+	default:
+		return fmt.Sprintf("%s requests limit exceeded (%d/%d)", limit.Name, current, limit.MaxRequests)
+	}
+}
+
+func rejectionReasonForTokens(limit WindowLimit, current int, tokens int32) string {
+	if limit.Name == "minute-tokens" {
+		return fmt.Sprintf("tokens per minute limit exceeded (%d+%d > %d)", current, tokens, limit.MaxTokens)
+	}
+	return fmt.Sprintf("%s tokens limit exceeded (%d+%d > %d)", limit.Name, current, tokens, limit.MaxTokens)
+}
+
+// populateLegacyFields fills the pre-Config.Limits CheckResult fields from
+// the sugar-expanded window names, so code written against
+// RequestsPerMinute/TokensPerMinute/RequestsPerDay keeps working even
+// though the underlying limiter is now window-generic. Callers using a
+// custom Config.Limits won't see these named windows and get zero values
+// here; they should read PerWindow instead.
+func populateLegacyFields(result *CheckResult, perWindow map[string]WindowUsage) {
+	if u, ok := perWindow["minute-requests"]; ok {
+		result.CurrentRequests = u.Requests
+		result.ResetMinute = u.ResetIn
+	}
+	if u, ok := perWindow["minute-tokens"]; ok {
+		result.CurrentTokens = u.Tokens
+		if result.ResetMinute == 0 {
+			result.ResetMinute = u.ResetIn
+		}
+	}
+	if u, ok := perWindow["day-requests"]; ok {
+		result.CurrentDayReqs = u.Requests
+		result.ResetDay = u.ResetIn
+	}
+}
+
+// rollbackWindows gives back a reservation's usage using the exact keys it
+// was checked against. Those keys must come from the same call's
+// checkAndIncrementWindowsKeyed result, not be recomputed here: window keys
+// are time-bucketed, so deriving them from time.Now() at rollback time
+// would silently decrement a different (and usually still-empty) window
+// once the original one has rolled over.
+func (rl *RateLimiter) rollbackWindows(ctx context.Context, cfg Config, tokens int32, keys []string) error {
+	limits := resolvedLimits(cfg)
+
+	_, err := evalScript(ctx, rl.redis, rl.windowsRollback, windowsRollbackScript, keys, len(limits), int64(tokens))
+	if err != nil {
+		return fmt.Errorf("failed to roll back reservation: %w", err)
+	}
+	return nil
+}